@@ -17,13 +17,17 @@ limitations under the License.
 package cache
 
 import (
-	"math"
+	"context"
+	"math/bits"
 	"math/rand"
 	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog/v2"
 )
 
@@ -31,6 +35,19 @@ const (
 	MovingInterval        = 10 * time.Second
 	MaxOutputLen          = 4096 // TODO: override this value if profile is provided.
 	DefaultColdPrediction = OptimisticColdPrediction
+
+	// DefaultMinBucketBit (B_min) is the bit below which token counts are bucketed
+	// linearly instead of logarithmically, so small outputs are not all crushed into bucket 0.
+	DefaultMinBucketBit = 5
+	// DefaultSubBucketBits (S) is the number of sub-buckets per bucket, as a power of two,
+	// bounding the relative error within a bucket to roughly 1/2^S.
+	DefaultSubBucketBits = 3
+	// DefaultRotationJitter bounds the random delay added to each aligned rotation tick, so
+	// many predictors started together in the same process don't all rotate in lockstep.
+	DefaultRotationJitter = MovingInterval / 20
+
+	metricsNamespace = "aibrix"
+	metricsSubsystem = "output_predictor"
 )
 
 const (
@@ -50,20 +67,63 @@ type ColdPredictionStrategy int
 // SimpleOutputPredictor collects moving histogram of output tokens of completed requests corresponding each input token buckets,
 // and uses weighted random to predict output tokens for a specific request.
 // Usage:
-// 1. NewSimpleOutputPredictor() with max input and output estimation, specifying the window size.
-// 2. AddTrace() to collect seen output tokens. Output tokens will be categorized in input token bucket of round(log2(input tokens)).
-// 3. Call Predict() to get a prediction of number of output tokens by the number of input tokens.
+//  1. NewSimpleOutputPredictor() with max input and output estimation, specifying the window size.
+//  2. AddTrace() to collect seen output tokens. Output tokens will be categorized using HDR-style log-linear bucketing,
+//     see token2bucket for details.
+//  3. Call Predict() to get a prediction of number of output tokens by the number of input tokens.
 type SimpleOutputPredictor struct {
-	history       rotatingHistory
-	inputs        outputDistribution
-	inputsSums    []int32
-	inputBuckets  int
-	outputBuckets int
-
-	mu       sync.RWMutex
-	rand     func(int32) int32
-	testing  bool
-	testWait sync.WaitGroup
+	history         rotatingHistory
+	inputs          outputDistribution
+	inputsSums      []int32
+	inputBuckets    int // includes the underflow (index 0) and overflow (last index) rows.
+	outputBuckets   int // includes the underflow (index 0) and overflow (last index) columns.
+	minBucketBit    int // B_min: tokens below 2^minBucketBit are bucketed linearly.
+	subBucketBits   int // S: 2^subBucketBits sub-buckets per bucket.
+	maxInputTokens  int
+	maxOutputTokens int
+
+	// totalTraces, underflowTotal, overflowTotal and rotationsTotal are cumulative and never
+	// reset by rotation, unlike inputs/inputsSums, so they make honest Prometheus counters; see
+	// RegisterMetrics.
+	totalTraces    uint64
+	underflowTotal uint64
+	overflowTotal  uint64
+	rotationsTotal uint64
+	// metrics holds the descriptors built by RegisterMetrics. Nil until then, so a predictor
+	// that's never registered pays nothing and Describe/Collect are safe no-ops.
+	metrics *predictorMetricDescs
+
+	// heads double-buffers the in-progress interval's counts so AddTrace never blocks on
+	// rotate, following the hot/cold technique used by prometheus/client_golang's histogram.
+	// countAndHotIdx's top bit selects which of heads is hot; its remaining bits are a
+	// dispatch sequence shared by both sides, never reset, so a write's own sequence number
+	// pins which side it was routed to for the lifetime of the predictor. completed mirrors
+	// that sequence per side so rotate can tell once every write routed to the set it just
+	// made cold has actually landed before folding and reusing it.
+	heads          [2]outputDistribution
+	completed      [2]uint64
+	countAndHotIdx uint64
+	// hotSince is the dispatch sequence value at which the currently hot side began its
+	// tenure. Only rotate (driven single-flight by the Start ticker) reads or writes it.
+	hotSince uint64
+
+	// ticker drives rotation; see Start. Injectable so tests can control rotation without
+	// waiting on wall-clock time.
+	ticker   tickSource
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	rand    func(int32) int32
+	testing bool
+	// testMu guards testGate. When testing, Start's ticker loop opens a fresh gate before each
+	// rotate and closes it once rotate returns; AddTrace blocks on whichever gate it read under
+	// testMu. Each tick gets its own channel rather than reusing one sync.WaitGroup, so a new
+	// gate can never be opened while a previous one's waiters are still being released - the
+	// hazard a shared WaitGroup has here, since Add and Wait/Done run from independent goroutines
+	// with no ordering relationship between them.
+	testMu   sync.Mutex
+	testGate chan struct{}
 }
 
 // Inputs/Output distribution
@@ -117,7 +177,7 @@ func (hist *rotatingHistory) Size() int32 {
 	return atomic.LoadInt32(&hist.size)
 }
 
-func (hist *rotatingHistory) forwardLocked(ts time.Time) int32 {
+func (hist *rotatingHistory) forward(ts time.Time) int32 {
 	if ts.Sub(hist.headTimestamp) < MovingInterval {
 		return 0
 	}
@@ -144,23 +204,40 @@ func (hist *rotatingHistory) resetTail(distributions outputDistribution, sums []
 }
 
 func NewSimpleOutputPredictor(maxInputTokens, maxOutputTokens int, window time.Duration) *SimpleOutputPredictor {
+	return NewSimpleOutputPredictorWithPrecision(maxInputTokens, maxOutputTokens, window, DefaultMinBucketBit, DefaultSubBucketBits)
+}
+
+// NewSimpleOutputPredictorWithPrecision is NewSimpleOutputPredictor with explicit control over the
+// HDR-style bucketing precision, see token2bucket for the meaning of minBucketBit and subBucketBits.
+func NewSimpleOutputPredictorWithPrecision(maxInputTokens, maxOutputTokens int, window time.Duration, minBucketBit, subBucketBits int) *SimpleOutputPredictor {
 	// We allocate 1 more history slot to make summary update on rotating lock free
 	extraSlot := 1
 	if window%MovingInterval > 0 {
 		extraSlot++
 	}
-	inputBuckets := int(math.Ceil(math.Log2(float64(maxInputTokens + 1))))
-	outputBuckets := int(math.Ceil(math.Log2(float64(maxOutputTokens + 1))))
+	// +2 reserves an underflow row/column (index 0) and an overflow row/column (last index)
+	// on both axes, so out-of-range tokens are counted explicitly instead of folded into bucket 0
+	// or the last regular bucket.
+	inputBuckets := bucketCount(maxInputTokens, minBucketBit, subBucketBits) + 2
+	outputBuckets := bucketCount(maxOutputTokens, minBucketBit, subBucketBits) + 2
 	predictor := &SimpleOutputPredictor{
 		history: rotatingHistory{
 			window:        make([]outputDistribution, int(window/MovingInterval)+extraSlot),
 			headTimestamp: time.Now(),
 		},
-		inputs:        make(outputDistribution, inputBuckets*outputBuckets),
-		inputsSums:    make([]int32, inputBuckets),
-		inputBuckets:  inputBuckets,
-		outputBuckets: outputBuckets,
-		rand:          rand.Int31n,
+		inputs:          make(outputDistribution, inputBuckets*outputBuckets),
+		inputsSums:      make([]int32, inputBuckets),
+		inputBuckets:    inputBuckets,
+		outputBuckets:   outputBuckets,
+		minBucketBit:    minBucketBit,
+		subBucketBits:   subBucketBits,
+		maxInputTokens:  maxInputTokens,
+		maxOutputTokens: maxOutputTokens,
+		heads: [2]outputDistribution{
+			make(outputDistribution, inputBuckets*outputBuckets),
+			make(outputDistribution, inputBuckets*outputBuckets),
+		},
+		rand: rand.Int31n,
 	}
 	for i := 0; i < len(predictor.history.window); i++ {
 		predictor.history.window[i] = make(outputDistribution, inputBuckets*outputBuckets+1)
@@ -168,52 +245,225 @@ func NewSimpleOutputPredictor(maxInputTokens, maxOutputTokens int, window time.D
 	return predictor
 }
 
-func (p *SimpleOutputPredictor) AddTraceWithTimestamp(inputTokens, outputTokens int, cnt int32, ts time.Time) {
-	p.tryRotate(ts)
+// bucketCount returns the number of HDR-style raw buckets needed so the bucket containing
+// maxTokens is the last regular one. Note this is not (B_max - B_min + 1) * 2^S: that would make
+// the last regular bucket span encodeBucketRaw's entire outer power-of-two range, which extends
+// well past maxTokens whenever maxTokens doesn't fall exactly on a sub-bucket boundary (e.g.
+// maxTokens itself a power of two, as the repo's own MaxOutputLen default is, spans all the way to
+// 2*maxTokens-1) - see token2bucket for how that's still guarded even so.
+func bucketCount(maxTokens, minBucketBit, subBucketBits int) int {
+	if maxTokens <= 0 {
+		return 1
+	}
+	return encodeBucketRaw(maxTokens, minBucketBit, subBucketBits) + 1
+}
 
-	inputBucket := p.token2bucket(inputTokens, p.inputBuckets)
-	idx := p.bucket2idx(inputBucket, p.token2bucket(outputTokens, p.outputBuckets))
+// encodeBucketRaw is encodeBucket's precision-parameterized bucketing rule, split out so
+// bucketCount can size the bucket axis from the same math encodeBucket uses to place tokens in
+// it.
+func encodeBucketRaw(tokens, minBucketBit, subBucketBits int) int {
+	subBuckets := 1 << subBucketBits
+	var outer, sub int
+	if tokens >= (1 << minBucketBit) {
+		msb := bits.Len(uint(tokens)) - 1 // floor(log2(tokens))
+		outer = msb - minBucketBit + 1
+		shift := uint(outer - 1 + minBucketBit - subBucketBits)
+		sub = int((uint(tokens) >> shift) & uint(subBuckets-1))
+	} else {
+		shift := minBucketBit - subBucketBits
+		if shift < 0 {
+			shift = 0
+		}
+		sub = tokens >> uint(shift)
+		if sub >= subBuckets {
+			sub = subBuckets - 1
+		}
+	}
+	return outer*subBuckets + sub
+}
+
+// AddTraceWithTimestamp records a trace. ts is not used: rotation is driven by the ticker
+// started by Start, and the trace is counted in the current interval whatever ts says.
+func (p *SimpleOutputPredictor) AddTraceWithTimestamp(inputTokens, outputTokens int, cnt int32, ts time.Time) {
+	inputBucket := p.token2bucket(inputTokens, p.inputBuckets, p.maxInputTokens)
+	outputBucket := p.token2bucket(outputTokens, p.outputBuckets, p.maxOutputTokens)
+	idx := p.bucket2idx(inputBucket, outputBucket)
 
 	// In testing, enforce time series
 	if p.testing {
-		p.testWait.Wait()
+		p.testMu.Lock()
+		gate := p.testGate
+		p.testMu.Unlock()
+		if gate != nil {
+			<-gate
+		}
 	}
 
-	// Avoid operations during rotating
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	// Claim a dispatch sequence number and learn the hot side atomically, so a racing rotate
+	// can never observe this write as "dispatched" to one side while it lands in the other.
+	n := atomic.AddUint64(&p.countAndHotIdx, 1)
+	hotIdx := n >> 63
 
-	// Add summary first and history next to avoid possible negative summary on rotating.
+	// Add summary first and head next to avoid possible negative summary on rotating.
 	atomic.AddInt32(&p.inputs[idx], cnt)
 	atomic.AddInt32(&p.inputsSums[inputBucket], cnt)
-	atomic.AddInt32(&p.history.window[p.history.head][idx], cnt)
+	atomic.AddInt32(&p.heads[hotIdx][idx], cnt)
+	atomic.AddUint64(&p.completed[hotIdx], 1)
+
+	atomic.AddUint64(&p.totalTraces, uint64(cnt))
+	if inputBucket == 0 || outputBucket == 0 {
+		atomic.AddUint64(&p.underflowTotal, uint64(cnt))
+	}
+	if inputBucket == p.inputBuckets-1 || outputBucket == p.outputBuckets-1 {
+		atomic.AddUint64(&p.overflowTotal, uint64(cnt))
+	}
 }
 
 func (p *SimpleOutputPredictor) AddTrace(inputTokens, outputTokens int, cnt int32) {
 	p.AddTraceWithTimestamp(inputTokens, outputTokens, cnt, time.Now())
 }
 
-func (p *SimpleOutputPredictor) Predict(inputTokens int) int {
-	inputBucket := p.token2bucket(inputTokens, p.inputBuckets)
+// Predict returns a weighted-random sample of output tokens for the given input tokens, and
+// whether the sample landed in the overflow bucket. When overflowed is true, the returned value
+// is maxOutputTokens, a saturation signal rather than a real observed prediction.
+//
+// This is a breaking change from the prior func(int) int signature; grep found no other callers
+// of Predict in this tree to update alongside it.
+func (p *SimpleOutputPredictor) Predict(inputTokens int) (int, bool) {
+	inputBucket := p.token2bucket(inputTokens, p.inputBuckets, p.maxInputTokens)
 	randRange := atomic.LoadInt32(&p.inputsSums[inputBucket])
 	if randRange == int32(0) {
-		return p.coldPredict(inputTokens) // No history, return input tokens
+		return p.coldPredict(inputTokens), false // No history, use DefaultColdPrediction
 	}
 	// Do weighted random
 	cursor := p.rand(randRange)
 	accumulation := int32(0)
-	scanRange := (inputBucket + 1) * p.outputBuckets
-	for i := scanRange - p.outputBuckets; i < scanRange; i++ {
+	rowStart := inputBucket * p.outputBuckets
+	scanRange := rowStart + p.outputBuckets
+	for i := rowStart; i < scanRange; i++ {
 		accumulation += atomic.LoadInt32(&p.inputs[i])
 		if cursor < accumulation {
-			return int(math.Pow(2, float64(i-scanRange+p.outputBuckets)))
+			return p.decodeOutputBucket(i - rowStart)
+		}
+	}
+	return p.maxOutputTokens, true
+}
+
+// PredictQuantile returns a conservative prediction of output tokens: the smallest token count
+// whose cumulative share of the observed distribution for inputTokens is at least q, suitable for
+// admission control and KV-cache reservation where a weighted-random sample (see Predict) is
+// too optimistic. See PredictQuantileWithColdPrediction to choose the cold-start strategy.
+func (p *SimpleOutputPredictor) PredictQuantile(inputTokens int, q float64) int {
+	return p.PredictQuantileWithColdPrediction(inputTokens, q, DefaultColdPrediction)
+}
+
+// PredictQuantileWithColdPrediction is PredictQuantile with explicit control over the cold-start
+// strategy, see NewSimpleOutputPredictorWithPrecision for the analogous pattern.
+func (p *SimpleOutputPredictor) PredictQuantileWithColdPrediction(inputTokens int, q float64, coldPrediction ColdPredictionStrategy) int {
+	return p.PredictQuantilesWithColdPrediction(inputTokens, []float64{q}, coldPrediction)[0]
+}
+
+// PredictQuantiles is PredictQuantile for multiple quantiles, computed in a single scan over the
+// output histogram. See PredictQuantilesWithColdPrediction to choose the cold-start strategy.
+func (p *SimpleOutputPredictor) PredictQuantiles(inputTokens int, qs []float64) []int {
+	return p.PredictQuantilesWithColdPrediction(inputTokens, qs, DefaultColdPrediction)
+}
+
+// PredictQuantilesWithColdPrediction is PredictQuantiles with explicit control over the cold-start
+// strategy, see NewSimpleOutputPredictorWithPrecision for the analogous pattern.
+func (p *SimpleOutputPredictor) PredictQuantilesWithColdPrediction(inputTokens int, qs []float64, coldPrediction ColdPredictionStrategy) []int {
+	inputBucket := p.token2bucket(inputTokens, p.inputBuckets, p.maxInputTokens)
+	randRange := atomic.LoadInt32(&p.inputsSums[inputBucket])
+	results := make([]int, len(qs))
+	if randRange == int32(0) {
+		cold := p.coldPredictWithStrategy(inputTokens, coldPrediction) // No history, use coldPrediction
+		for i := range results {
+			results[i] = cold
+		}
+		return results
+	}
+
+	// Visit qs in ascending order so the cumulative sum only needs a single forward scan.
+	order := make([]int, len(qs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return qs[order[a]] < qs[order[b]] })
+
+	rowStart := inputBucket * p.outputBuckets
+	accumulation := int32(0)
+	next := 0
+	for col := 0; col < p.outputBuckets && next < len(order); col++ {
+		count := atomic.LoadInt32(&p.inputs[rowStart+col])
+		prevAccumulation := accumulation
+		accumulation += count
+		for next < len(order) && float64(accumulation) >= qs[order[next]]*float64(randRange) {
+			results[order[next]] = p.interpolateOutputBucket(col, qs[order[next]], prevAccumulation, count, randRange)
+			next++
 		}
 	}
-	return int(math.Pow(2, float64(p.outputBuckets-1)))
+	// Only reachable for q > 1 (or NaN), or when a concurrent rotation leaves the row's counts
+	// short of the inputsSums value read above.
+	for ; next < len(order); next++ {
+		results[order[next]] = p.maxOutputTokens
+	}
+	return results
+}
+
+// interpolateOutputBucket linearly interpolates a token count within output bucket col's token
+// range, placing q's target cumulative count at prevAccumulation+count*fraction. Respects the
+// underflow (col 0) and overflow (last col) buckets, returning 0 and maxOutputTokens respectively.
+func (p *SimpleOutputPredictor) interpolateOutputBucket(col int, q float64, prevAccumulation, count, total int32) int {
+	if col == 0 {
+		return 0
+	}
+	if col == p.outputBuckets-1 {
+		return p.maxOutputTokens
+	}
+	low, high := p.rawBucketBounds(col - 1)
+	if high > p.maxOutputTokens {
+		high = p.maxOutputTokens
+	}
+	if count <= 0 {
+		return low
+	}
+	fraction := (q*float64(total) - float64(prevAccumulation)) / float64(count)
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	return low + int(fraction*float64(high-low))
+}
+
+// PredictorStats reports how often tokens fell outside the configured max input/output, so
+// operators can tell that the configured max is too small instead of silently losing signal.
+type PredictorStats struct {
+	InputUnderflow  int32
+	InputOverflow   int32
+	OutputUnderflow int32
+	OutputOverflow  int32
+}
+
+// Stats returns the current underflow/overflow counts across the live window.
+func (p *SimpleOutputPredictor) Stats() PredictorStats {
+	stats := PredictorStats{
+		InputUnderflow: atomic.LoadInt32(&p.inputsSums[0]),
+		InputOverflow:  atomic.LoadInt32(&p.inputsSums[p.inputBuckets-1]),
+	}
+	for inputBucket := 0; inputBucket < p.inputBuckets; inputBucket++ {
+		stats.OutputUnderflow += atomic.LoadInt32(&p.inputs[p.bucket2idx(inputBucket, 0)])
+		stats.OutputOverflow += atomic.LoadInt32(&p.inputs[p.bucket2idx(inputBucket, p.outputBuckets-1)])
+	}
+	return stats
 }
 
 func (p *SimpleOutputPredictor) coldPredict(inputTokens int) int {
-	switch DefaultColdPrediction {
+	return p.coldPredictWithStrategy(inputTokens, DefaultColdPrediction)
+}
+
+func (p *SimpleOutputPredictor) coldPredictWithStrategy(inputTokens int, strategy ColdPredictionStrategy) int {
+	switch strategy {
 	case RandomColdPredition:
 		return rand.Intn(MaxOutputLen) + 1
 	case InputColdPrediction:
@@ -230,31 +480,157 @@ func (p *SimpleOutputPredictor) bucket2idx(inputBucket, outputBucket int) int {
 	return inputBucket*p.outputBuckets + outputBucket
 }
 
-func (p *SimpleOutputPredictor) token2bucket(tokens int, limit int) int {
-	bucket := 0
-	if tokens > 0 {
-		bucket = int(math.Round(math.Log2(float64(tokens))))
+// encodeBucket computes the raw, unpadded HDR-style bucket for tokens > 0: values below
+// 2^minBucketBit fall into bucket 0's linearly-spaced sub-buckets, while values
+// v >= 2^minBucketBit are placed at outer bucket floor(log2(v))-minBucketBit+1, sub-bucket
+// (v>>(outer-1+minBucketBit-subBucketBits))&(2^subBucketBits-1). The flat bucket index
+// returned is outer*2^subBucketBits+sub, unbounded.
+func (p *SimpleOutputPredictor) encodeBucket(tokens int) int {
+	return encodeBucketRaw(tokens, p.minBucketBit, p.subBucketBits)
+}
+
+// token2bucket maps tokens onto a padded bucket axis of the given size: index 0 is the
+// underflow bucket (tokens <= 0), index limit-1 is the overflow bucket (tokens above maxTokens,
+// or beyond what encodeBucket can represent within limit-2 regular buckets), and the rest are
+// encodeBucket's raw buckets shifted by one. Unlike plain clamping, underflow and overflow are
+// never folded into a regular bucket, so callers can tell saturation from a real observation.
+//
+// The explicit tokens > maxTokens check matters even though encodeBucket is monotonic: the outer
+// HDR bucket containing maxTokens always spans a full power-of-two range, which can extend well
+// past maxTokens (e.g. maxTokens itself a power of two spans all the way to 2*maxTokens-1), so
+// relying on encodeBucket's raw index alone would silently accept tokens beyond maxTokens as a
+// regular, non-overflow observation.
+func (p *SimpleOutputPredictor) token2bucket(tokens int, limit int, maxTokens int) int {
+	if tokens <= 0 {
+		return 0
 	}
-	if bucket >= limit {
-		bucket = limit - 1
+	if tokens > maxTokens {
+		return limit - 1
 	}
-	return bucket
+	raw := p.encodeBucket(tokens)
+	if raw >= limit-2 {
+		return limit - 1
+	}
+	return raw + 1
 }
 
-func (p *SimpleOutputPredictor) tryRotate(ts time.Time) {
-	if ts.Sub(p.history.headTimestamp) < MovingInterval {
-		return
+// rawBucketBounds returns the inclusive [low, high] token range that encodeBucket maps to the
+// given raw bucket.
+func (p *SimpleOutputPredictor) rawBucketBounds(bucket int) (low, high int) {
+	subBuckets := 1 << p.subBucketBits
+	outer := bucket / subBuckets
+	sub := bucket % subBuckets
+
+	if outer == 0 {
+		shift := p.minBucketBit - p.subBucketBits
+		if shift < 0 {
+			shift = 0
+		}
+		low = sub << uint(shift)
+		high = low + (1 << uint(shift)) - 1
+		return low, high
 	}
-	if p.testing {
-		p.testWait.Add(1)
+
+	shift := uint(outer - 1 + p.minBucketBit - p.subBucketBits)
+	base := 1 << uint(outer-1+p.minBucketBit)
+	low = base | (sub << shift)
+	high = low + (1 << shift) - 1
+	return low, high
+}
+
+// bucket2tokens is the inverse of encodeBucket, reconstructing a representative token count as
+// the midpoint of the raw bucket's token range. The range is capped to maxOutputTokens, since the
+// raw bucket containing maxOutputTokens can span past it (see token2bucket).
+func (p *SimpleOutputPredictor) bucket2tokens(bucket int) int {
+	low, high := p.rawBucketBounds(bucket)
+	if high > p.maxOutputTokens {
+		high = p.maxOutputTokens
+	}
+	return (low + high) / 2
+}
+
+// decodeOutputBucket translates a padded output-axis column back into a token count, reporting
+// overflowed=true when col is the overflow column so callers can distinguish saturation against
+// maxOutputTokens from a real in-range prediction.
+func (p *SimpleOutputPredictor) decodeOutputBucket(col int) (tokens int, overflowed bool) {
+	if col == 0 {
+		return 0, false
+	}
+	if col == p.outputBuckets-1 {
+		return p.maxOutputTokens, true
+	}
+	return p.bucket2tokens(col - 1), false
+}
+
+// inputBucketBounds translates a padded input-axis row into the inclusive [low, high] token
+// range it represents, for labeling metrics; unlike decodeOutputBucket it reports the full range
+// rather than a single representative value. The underflow row is reported as [0, 0] and the
+// overflow row as [maxInputTokens+1, largest int].
+func (p *SimpleOutputPredictor) inputBucketBounds(row int) (low, high int) {
+	if row == 0 {
+		return 0, 0
+	}
+	if row == p.inputBuckets-1 {
+		return p.maxInputTokens + 1, int(^uint(0) >> 1)
+	}
+	low, high = p.rawBucketBounds(row - 1)
+	if high > p.maxInputTokens {
+		high = p.maxInputTokens
+	}
+	return low, high
+}
+
+// Start begins rotating the window on a background, wall-clock-aligned ticker. It must be
+// called once before traces are expected to age out of the window, and paired with Stop.
+func (p *SimpleOutputPredictor) Start(ctx context.Context) {
+	if p.ticker == nil {
+		p.ticker = newAlignedTicker(MovingInterval, DefaultRotationJitter)
 	}
-	go p.rotate(ts)
-	runtime.Gosched() // allow rotate first.
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			select {
+			case tick := <-p.ticker.C():
+				if p.testing {
+					p.testMu.Lock()
+					p.testGate = make(chan struct{})
+					p.testMu.Unlock()
+				}
+				p.rotate(tick)
+			case <-p.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the rotation ticker started by Start and waits for it to exit. Safe to call more
+// than once, e.g. once from a defer and once from an explicit shutdown handler.
+func (p *SimpleOutputPredictor) Stop() {
+	p.stopOnce.Do(func() {
+		if p.ticker != nil {
+			p.ticker.Stop()
+		}
+		if p.stop != nil {
+			close(p.stop)
+		}
+		p.wg.Wait()
+	})
 }
 
 func (p *SimpleOutputPredictor) rotate(ts time.Time) bool {
 	if p.testing {
-		defer p.testWait.Done()
+		defer func() {
+			p.testMu.Lock()
+			gate := p.testGate
+			p.testGate = nil
+			p.testMu.Unlock()
+			close(gate)
+		}()
 	}
 
 	window := int32(len(p.history.window) - 1)
@@ -263,16 +639,37 @@ func (p *SimpleOutputPredictor) rotate(ts time.Time) bool {
 		return false
 	}
 
-	// log.Printf("size %d", p.history.size)
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
 	// Calculate how many intervals we need to forward.
 	// This is usually 1, for sparse workloads, this can be > 1.
-	if p.history.forwardLocked(ts) == 0 {
+	forwarded := p.history.forward(ts)
+	if forwarded == 0 {
 		// Already forwarded
 		return true
 	}
+	atomic.AddUint64(&p.rotationsTotal, uint64(forwarded))
+
+	// Flip which head set AddTrace writes into, then wait lock-free for the writes that were
+	// already dispatched to the now-cold set to land, following the hot/cold technique used by
+	// prometheus/client_golang's histogram (see the SimpleOutputPredictor field comments).
+	flipped := atomic.AddUint64(&p.countAndHotIdx, 1<<63)
+	coldIdx := (flipped >> 63) ^ 1
+	dispatchedToCold := flipped&((1<<63)-1) - p.hotSince
+	for atomic.LoadUint64(&p.completed[coldIdx]) != dispatchedToCold {
+		runtime.Gosched()
+	}
+	p.hotSince = flipped & ((1 << 63) - 1)
+
+	// Fold the now-drained cold set into the freshly advanced head slot, then clear it so it's
+	// ready to become hot again next rotation.
+	cold := p.heads[coldIdx]
+	newHead := p.history.Head()
+	for i, v := range cold {
+		if v != 0 {
+			newHead[i] = v
+			cold[i] = 0
+		}
+	}
+	atomic.StoreUint64(&p.completed[coldIdx], 0)
 
 	// Remove olded data from summary and reset history of number min(forwarded, len(p.history.window) - 1)
 	// Noted that the
@@ -283,3 +680,183 @@ func (p *SimpleOutputPredictor) rotate(ts time.Time) bool {
 	}
 	return true
 }
+
+// tickSource is satisfied by AlignedTicker; tests can supply a fake to control rotation
+// without waiting on wall-clock time.
+type tickSource interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// AlignedTicker fires on wall-clock multiples of interval, as telegraf's input loops do, so
+// the window doesn't drift the way measuring elapsed time from the last fire would. An
+// optional jitter spreads out the fires of many predictors started together in one process.
+type AlignedTicker struct {
+	interval time.Duration
+	jitter   time.Duration
+	now      func() time.Time // injectable for tests
+
+	c        chan time.Time
+	done     chan struct{}
+	doneOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newAlignedTicker(interval, jitter time.Duration) *AlignedTicker {
+	t := &AlignedTicker{
+		interval: interval,
+		jitter:   jitter,
+		now:      time.Now,
+		c:        make(chan time.Time, 1),
+		done:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+func (t *AlignedTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *AlignedTicker) run() {
+	defer t.wg.Done()
+	for {
+		timer := time.NewTimer(time.Until(t.nextFire()))
+		select {
+		case fired := <-timer.C:
+			select {
+			case t.c <- fired:
+			default:
+				// Previous tick hasn't been drained yet; rotate's forward() catches up
+				// multiple elapsed intervals in one call, so dropping this tick is safe.
+			}
+		case <-t.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (t *AlignedTicker) nextFire() time.Time {
+	aligned := t.now().Truncate(t.interval).Add(t.interval)
+	if t.jitter > 0 {
+		aligned = aligned.Add(time.Duration(rand.Int63n(int64(t.jitter))))
+	}
+	return aligned
+}
+
+// Stop halts the ticker and waits for its goroutine to exit. Safe to call more than once.
+func (t *AlignedTicker) Stop() {
+	t.doneOnce.Do(func() {
+		close(t.done)
+	})
+	t.wg.Wait()
+}
+
+// predictorMetricDescs holds the prometheus.Desc handles built once by RegisterMetrics.
+type predictorMetricDescs struct {
+	tracesTotal    *prometheus.Desc
+	underflowTotal *prometheus.Desc
+	overflowTotal  *prometheus.Desc
+	rotationsTotal *prometheus.Desc
+	outputTokens   *prometheus.Desc
+}
+
+// RegisterMetrics builds this predictor's metric descriptors, attaching labels (e.g. model name)
+// so multiple predictors can coexist in one registry, and registers it as a prometheus.Collector.
+// It must be called at most once per predictor.
+func (p *SimpleOutputPredictor) RegisterMetrics(reg prometheus.Registerer, labels prometheus.Labels) error {
+	p.metrics = &predictorMetricDescs{
+		tracesTotal: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "traces_total"),
+			"Cumulative number of traces recorded by the predictor.",
+			nil, labels,
+		),
+		underflowTotal: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "underflow_total"),
+			"Cumulative number of traces whose input or output token count underflowed the configured bucketing range.",
+			nil, labels,
+		),
+		overflowTotal: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "overflow_total"),
+			"Cumulative number of traces whose input or output token count overflowed the configured bucketing range.",
+			nil, labels,
+		),
+		rotationsTotal: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "rotations_total"),
+			"Cumulative number of window rotations.",
+			nil, labels,
+		),
+		outputTokens: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "output_tokens"),
+			"Histogram of observed output tokens, bucketed per input token bucket using the HDR-style bucketing scheme.",
+			[]string{"input_tokens_low", "input_tokens_high"}, labels,
+		),
+	}
+	return reg.Register(p)
+}
+
+// Describe implements prometheus.Collector. Before RegisterMetrics has run it sends nothing, so
+// an unregistered predictor is a safe no-op collector.
+func (p *SimpleOutputPredictor) Describe(ch chan<- *prometheus.Desc) {
+	if p.metrics == nil {
+		return
+	}
+	ch <- p.metrics.tracesTotal
+	ch <- p.metrics.underflowTotal
+	ch <- p.metrics.overflowTotal
+	ch <- p.metrics.rotationsTotal
+	ch <- p.metrics.outputTokens
+}
+
+// Collect implements prometheus.Collector. The cumulative counters are exact; the per-bucket
+// histograms are assembled cell by cell from the same atomics AddTrace and rotate use, the way
+// Stats does, so a concurrent rotation can shift a few counts between buckets but every read is
+// individually consistent and the snapshot converges between scrapes.
+func (p *SimpleOutputPredictor) Collect(ch chan<- prometheus.Metric) {
+	if p.metrics == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(p.metrics.tracesTotal, prometheus.CounterValue, float64(atomic.LoadUint64(&p.totalTraces)))
+	ch <- prometheus.MustNewConstMetric(p.metrics.underflowTotal, prometheus.CounterValue, float64(atomic.LoadUint64(&p.underflowTotal)))
+	ch <- prometheus.MustNewConstMetric(p.metrics.overflowTotal, prometheus.CounterValue, float64(atomic.LoadUint64(&p.overflowTotal)))
+	ch <- prometheus.MustNewConstMetric(p.metrics.rotationsTotal, prometheus.CounterValue, float64(atomic.LoadUint64(&p.rotationsTotal)))
+
+	for inputBucket := 0; inputBucket < p.inputBuckets; inputBucket++ {
+		rowStart := inputBucket * p.outputBuckets
+		buckets := make(map[float64]uint64, p.outputBuckets-1)
+		var count uint64
+		var sum float64
+		for col := 0; col < p.outputBuckets; col++ {
+			v := atomic.LoadInt32(&p.inputs[rowStart+col])
+			if v < 0 {
+				v = 0
+			}
+			count += uint64(v)
+			tokens, _ := p.decodeOutputBucket(col)
+			sum += float64(tokens) * float64(v)
+
+			// The overflow column has no finite upper bound of its own; buckets hold cumulative
+			// counts, so its mass appears only in the implicit +Inf bucket, whose value is count.
+			if col == p.outputBuckets-1 {
+				continue
+			}
+			boundary := 0.0
+			if col > 0 {
+				_, high := p.rawBucketBounds(col - 1)
+				if high > p.maxOutputTokens {
+					high = p.maxOutputTokens
+				}
+				boundary = float64(high)
+			}
+			buckets[boundary] = count
+		}
+
+		low, high := p.inputBucketBounds(inputBucket)
+		ch <- prometheus.MustNewConstHistogram(
+			p.metrics.outputTokens, count, sum, buckets,
+			strconv.Itoa(low), strconv.Itoa(high),
+		)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2024 The Aibrix Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBucketRoundTrip checks token2bucket/encodeBucket/rawBucketBounds agree with each other:
+// buckets are monotonic in tokens, underflow/overflow are reported at the documented boundaries,
+// and every in-range token falls within the bounds reported for its own bucket.
+func TestBucketRoundTrip(t *testing.T) {
+	p := NewSimpleOutputPredictorWithPrecision(0, 4096, time.Minute, DefaultMinBucketBit, DefaultSubBucketBits)
+	limit := p.outputBuckets
+
+	if got := p.token2bucket(0, limit, p.maxOutputTokens); got != 0 {
+		t.Fatalf("token2bucket(0) = %d, want underflow bucket 0", got)
+	}
+	if got := p.token2bucket(-5, limit, p.maxOutputTokens); got != 0 {
+		t.Fatalf("token2bucket(-5) = %d, want underflow bucket 0", got)
+	}
+	if got := p.token2bucket(1<<30, limit, p.maxOutputTokens); got != limit-1 {
+		t.Fatalf("token2bucket(2^30) = %d, want overflow bucket %d", got, limit-1)
+	}
+
+	prevBucket := 0
+	for tokens := 1; tokens <= p.maxOutputTokens; tokens++ {
+		bucket := p.token2bucket(tokens, limit, p.maxOutputTokens)
+		if bucket < prevBucket {
+			t.Fatalf("token2bucket(%d) = %d is less than token2bucket(%d) = %d, want monotonic", tokens, bucket, tokens-1, prevBucket)
+		}
+		prevBucket = bucket
+
+		if bucket == 0 || bucket == limit-1 {
+			continue
+		}
+		low, high := p.rawBucketBounds(bucket - 1)
+		if tokens < low || tokens > high {
+			t.Fatalf("tokens=%d mapped to bucket %d with bounds [%d, %d], want tokens within bounds", tokens, bucket, low, high)
+		}
+	}
+}
+
+// TestBucketOverflowAtConfiguredMax pins the boundary the prior TestBucketRoundTrip never
+// exercised: maxOutputTokens itself a power of two (as the repo's own MaxOutputLen default is),
+// where the HDR outer bucket containing it naturally spans all the way to 2*maxOutputTokens-1.
+// tokens just above maxOutputTokens must overflow immediately, not somewhere up to ~2x it, and no
+// non-overflow value decoded by decodeOutputBucket may exceed maxOutputTokens.
+func TestBucketOverflowAtConfiguredMax(t *testing.T) {
+	for _, maxOutputTokens := range []int{256, 4096} {
+		p := NewSimpleOutputPredictorWithPrecision(0, maxOutputTokens, time.Minute, DefaultMinBucketBit, DefaultSubBucketBits)
+		limit := p.outputBuckets
+
+		if got := p.token2bucket(maxOutputTokens, limit, p.maxOutputTokens); got == limit-1 {
+			t.Fatalf("maxOutputTokens=%d: token2bucket(%d) overflowed, want the configured max itself to be in range", maxOutputTokens, maxOutputTokens)
+		}
+		if got := p.token2bucket(maxOutputTokens+1, limit, p.maxOutputTokens); got != limit-1 {
+			t.Fatalf("maxOutputTokens=%d: token2bucket(%d) = %d, want overflow bucket %d", maxOutputTokens, maxOutputTokens+1, got, limit-1)
+		}
+		if got := p.token2bucket(2*maxOutputTokens-1, limit, p.maxOutputTokens); got != limit-1 {
+			t.Fatalf("maxOutputTokens=%d: token2bucket(%d) = %d, want overflow bucket %d", maxOutputTokens, 2*maxOutputTokens-1, got, limit-1)
+		}
+
+		for col := 1; col < limit-1; col++ {
+			if tokens, overflowed := p.decodeOutputBucket(col); !overflowed && tokens > maxOutputTokens {
+				t.Fatalf("maxOutputTokens=%d: decodeOutputBucket(%d) = %d, want a non-overflow value no greater than the configured max", maxOutputTokens, col, tokens)
+			}
+		}
+	}
+}
+
+// TestPredictQuantilesMonotonic adds a skewed distribution for one input bucket and checks that
+// PredictQuantiles returns non-decreasing token counts as q increases, and that q=1 reaches the
+// upper end of the observed distribution (at least 500) rather than falling short of it.
+func TestPredictQuantilesMonotonic(t *testing.T) {
+	p := NewSimpleOutputPredictor(10, 1000, time.Minute)
+	for _, outputTokens := range []int{5, 50, 500, 999} {
+		p.AddTrace(1, outputTokens, 10)
+	}
+
+	qs := []float64{0.1, 0.5, 0.9, 0.99, 1.0}
+	results := p.PredictQuantiles(1, qs)
+
+	for i := 1; i < len(results); i++ {
+		if results[i] < results[i-1] {
+			t.Fatalf("PredictQuantiles(q=%v)=%d is less than PredictQuantiles(q=%v)=%d, want non-decreasing", qs[i], results[i], qs[i-1], results[i-1])
+		}
+	}
+	if results[len(results)-1] < 500 {
+		t.Fatalf("PredictQuantiles(q=1.0) = %d, want it to reach the upper end of the observed distribution", results[len(results)-1])
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2024 The Aibrix Team.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStatsCountsOverflowPastConfiguredMax pins this request's contract: values exceeding
+// maxInputTokens/maxOutputTokens accumulate in the overflow slot rather than being folded into
+// the last regular bucket. maxOutputTokens=4096 (the repo's own MaxOutputLen default) is itself a
+// power of two, the case the bucketing fix in encodeBucketRaw/bucketCount/token2bucket addresses.
+func TestStatsCountsOverflowPastConfiguredMax(t *testing.T) {
+	p := NewSimpleOutputPredictor(10, 4096, time.Minute)
+	p.AddTrace(10, 8000, 5)
+
+	stats := p.Stats()
+	if stats.OutputOverflow != 5 {
+		t.Fatalf("Stats().OutputOverflow = %d, want 5 for a trace whose output token count exceeds maxOutputTokens", stats.OutputOverflow)
+	}
+
+	if got, overflowed := p.decodeOutputBucket(p.outputBuckets - 1); !overflowed || got != p.maxOutputTokens {
+		t.Fatalf("decodeOutputBucket(overflow column) = (%d, %v), want (%d, true)", got, overflowed, p.maxOutputTokens)
+	}
+}
+
+// TestPredictQuantileSignalsOverflowAtMax checks PredictQuantile's "conservative upper bound"
+// contract: once a q=1.0 sample is driven purely by an overflowing trace, PredictQuantile must
+// saturate at maxOutputTokens rather than return a value past it.
+func TestPredictQuantileSignalsOverflowAtMax(t *testing.T) {
+	p := NewSimpleOutputPredictor(10, 4096, time.Minute)
+	p.AddTrace(1, 8000, 10)
+
+	q := p.PredictQuantile(1, 1.0)
+	if q > p.maxOutputTokens {
+		t.Fatalf("PredictQuantile(q=1.0) = %d, want it capped at maxOutputTokens (%d) rather than the overflowing observation", q, p.maxOutputTokens)
+	}
+}